@@ -6,14 +6,28 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"time"
+
+	"github.com/MatthewLavine/portknocker/pkg/knockd"
 )
 
 var (
-	host     = flag.String("host", "localhost", "The host to connect to")
-	basePort = flag.Int("basePort", 8080, "The base port to use for the server")
+	host             = flag.String("host", "localhost", "The host to connect to")
+	basePort         = flag.Int("basePort", 8080, "The base port to use for the server")
+	mode             = flag.String("mode", "sequence", "The knock mode to use: \"sequence\" for the multi-port knock, or \"spa\" for single packet authorization")
+	sequenceMode     = flag.String("sequenceMode", "static", "How to derive the knock sequence in --mode=sequence: \"static\" knocks 8081,8082,8083, \"totp\" derives a rotating sequence from --sharedSecret")
+	sequencePeriod   = flag.Duration("sequencePeriod", 30*time.Second, "How often the knock sequence rotates when --sequenceMode=totp, must match the server's --sequencePeriod")
+	knockLength      = flag.Int("knockLength", 3, "The number of ports to knock on when --sequenceMode=totp, must match the server's --knockLength")
+	portMin          = flag.Int("portMin", 8081, "The lowest port the rotating knock sequence may use when --sequenceMode=totp, must match the server's --portMin")
+	portMax          = flag.Int("portMax", 8090, "The highest port the rotating knock sequence may use when --sequenceMode=totp, must match the server's --portMax")
+	spaPort          = flag.Int("spaPort", 8081, "The UDP port to send the SPA packet to in --mode=spa")
+	sharedSecret     = flag.String("sharedSecret", "", "The shared secret used to authenticate SPA packets in --mode=spa or derive the rotating sequence in --sequenceMode=totp")
+	sharedSecretFile = flag.String("sharedSecretFile", "", "Path to a file containing the shared secret used in --mode=spa or --sequenceMode=totp, takes precedence over --sharedSecret")
+	accessDuration   = flag.Duration("accessDuration", 5*time.Minute, "The duration of access to request in --mode=spa")
 )
 
 func main() {
+	flag.Parse()
 	log.Println("Calling server without knocking")
 
 	resp, err := http.Get(fmt.Sprint("http://", *host, ":", *basePort))
@@ -27,11 +41,26 @@ func main() {
 
 	log.Println("Received expected 403")
 
-	log.Println("Knocking server")
-
-	knock(8081)
-	knock(8082)
-	knock(8083)
+	switch *mode {
+	case "sequence":
+		log.Println("Knocking server")
+		switch *sequenceMode {
+		case "totp":
+			step := knockd.TOTPStep(*sequencePeriod, time.Now())
+			for _, port := range knockd.TOTPSequence(loadSharedSecret(), step, *knockLength, *portMin, *portMax) {
+				knock(port)
+			}
+		default:
+			knock(8081)
+			knock(8082)
+			knock(8083)
+		}
+	case "spa":
+		log.Println("Sending SPA packet")
+		sendSpaPacket(*host, *spaPort, loadSharedSecret(), *accessDuration)
+	default:
+		log.Fatalf("Unknown --mode %q, want \"sequence\" or \"spa\"\n", *mode)
+	}
 
 	log.Println("Calling server again")
 
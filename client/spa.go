@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	spaPacketVersion = 1
+
+	spaVersionSize   = 1
+	spaNonceSize     = 16
+	spaTimestampSize = 8
+	spaDurationSize  = 8
+	spaHeaderSize    = spaVersionSize + spaNonceSize + spaTimestampSize + spaDurationSize
+)
+
+// sendSpaPacket builds and sends a single packet authorization datagram
+// requesting accessDuration of access, authenticated with secret.
+func sendSpaPacket(host string, port int, secret []byte, accessDuration time.Duration) {
+	packet, err := buildSpaPacket(secret, accessDuration)
+	if err != nil {
+		log.Fatalf("Failed to build SPA packet: %v\n", err)
+	}
+
+	conn, err := net.Dial("udp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		log.Fatalf("Failed to dial SPA server: %v\n", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write(packet); err != nil {
+		log.Fatalf("Failed to send SPA packet: %v\n", err)
+	}
+}
+
+func buildSpaPacket(secret []byte, accessDuration time.Duration) ([]byte, error) {
+	header := make([]byte, spaHeaderSize)
+	header[0] = spaPacketVersion
+
+	nonce := header[spaVersionSize : spaVersionSize+spaNonceSize]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("generating nonce: %w", err)
+	}
+
+	tsOffset := spaVersionSize + spaNonceSize
+	binary.BigEndian.PutUint64(header[tsOffset:tsOffset+spaTimestampSize], uint64(time.Now().Unix()))
+
+	durOffset := tsOffset + spaTimestampSize
+	binary.BigEndian.PutUint64(header[durOffset:durOffset+spaDurationSize], uint64(accessDuration))
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(header)
+
+	return append(header, mac.Sum(nil)...), nil
+}
+
+// loadSharedSecret resolves the shared secret from --sharedSecret or
+// --sharedSecretFile, preferring the file when both are set.
+func loadSharedSecret() []byte {
+	if *sharedSecretFile != "" {
+		b, err := os.ReadFile(*sharedSecretFile)
+		if err != nil {
+			log.Fatalf("Failed to read shared secret file: %v\n", err)
+		}
+		return []byte(strings.TrimSpace(string(b)))
+	}
+	if *sharedSecret != "" {
+		return []byte(*sharedSecret)
+	}
+	log.Fatal("--mode=spa and --sequenceMode=totp require --sharedSecret or --sharedSecretFile")
+	return nil
+}
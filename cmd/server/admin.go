@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/MatthewLavine/gracefulshutdown"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/MatthewLavine/portknocker/pkg/knockd"
+)
+
+// startAdminServer serves /metrics, /healthz and /debug/pprof on
+// --adminPort. These are operational endpoints, not part of the knock
+// protocol, so they get their own server and port rather than sharing the
+// base or knock servers.
+func startAdminServer(ctx context.Context, srv *knockd.Server) {
+	registerGauges(srv)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	s := &http.Server{
+		Addr:    fmt.Sprintf(":%d", *adminPort),
+		Handler: mux,
+	}
+	gracefulshutdown.AddShutdownHandler(func() error {
+		slog.Info("Shutting down admin server...")
+		defer slog.Info("Admin server shut down.")
+		return s.Shutdown(ctx)
+	})
+	go func() {
+		slog.Info("Admin server listening", "addr", s.Addr)
+		if err := s.ListenAndServe(); err != nil {
+			if err == http.ErrServerClosed {
+				return
+			}
+			fatal("Admin server failed", "addr", s.Addr, "error", err)
+		}
+	}()
+}
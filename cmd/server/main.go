@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MatthewLavine/gracefulshutdown"
+	"github.com/MatthewLavine/portknocker/pkg/knockd"
+)
+
+var (
+	mode                 = flag.String("mode", "sequence", "The knock mode to use: \"sequence\" for the multi-port knock, or \"spa\" for single packet authorization")
+	basePort             = flag.Int("basePort", 8080, "The base port to use for the server")
+	knockLength          = flag.Int("knockLength", 3, "The number of ports to knock on")
+	knockSequence        = flag.String("knockSequence", "8081,8082,8083", "The sequence of ports to knock on when --sequenceMode=static")
+	sequenceMode         = flag.String("sequenceMode", "static", "How the valid knock sequence is chosen: \"static\" uses --knockSequence, \"totp\" derives a rotating sequence from --sharedSecret")
+	sequencePeriod       = flag.Duration("sequencePeriod", 30*time.Second, "How often the knock sequence rotates when --sequenceMode=totp")
+	portMin              = flag.Int("portMin", 8081, "The lowest port a rotating knock sequence may use when --sequenceMode=totp")
+	portMax              = flag.Int("portMax", 8090, "The highest port a rotating knock sequence may use when --sequenceMode=totp")
+	accessDuration       = flag.Duration("accessDuration", 5*time.Minute, "The duration to allow access after a successful knock")
+	knockSessionTTL      = flag.Duration("knockSessionTTL", 10*time.Second, "How long an incomplete knock session may sit idle before it is garbage-collected")
+	knockRate            = flag.Float64("knockRate", 5, "The sustained number of knocks per second allowed from a single source IP")
+	knockBurst           = flag.Int("knockBurst", 10, "The number of knocks a single source IP may burst above --knockRate")
+	knockRateIdleTTL     = flag.Duration("knockRateIdleTTL", 5*time.Minute, "How long a source IP's rate limiter is kept idle before it is garbage-collected")
+	spaPort              = flag.Int("spaPort", 8081, "The UDP port to listen on for SPA packets in --mode=spa")
+	sharedSecret         = flag.String("sharedSecret", "", "The shared secret used to authenticate SPA packets in --mode=spa")
+	sharedSecretFile     = flag.String("sharedSecretFile", "", "Path to a file containing the shared secret used to authenticate SPA packets in --mode=spa, takes precedence over --sharedSecret")
+	spaWindow            = flag.Duration("spaWindow", 30*time.Second, "The allowed clock skew for SPA packet timestamps in --mode=spa")
+	spaNonceCacheSize    = flag.Int("spaNonceCacheSize", 4096, "The number of recently seen SPA nonces to remember for replay protection in --mode=spa")
+	spaMaxAccessDuration = flag.Duration("spaMaxAccessDuration", 5*time.Minute, "The maximum access duration an SPA packet may request in --mode=spa, regardless of what it asks for")
+	enforcerKind         = flag.String("enforcer", "noop", "The enforcer to use to grant access: \"noop\", \"nft\" or \"iptables\"")
+	enforcerChainName    = flag.String("enforcerChain", "PORTKNOCKER", "The iptables chain to manage when --enforcer=iptables")
+	enforcerSetName      = flag.String("enforcerSet", "portknocker_allowed", "The nftables set to manage when --enforcer=nft")
+	enforcerPortMin      = flag.Int("enforcerPortMin", 1, "The lowest port number to grant allowed peers access to")
+	enforcerPortMax      = flag.Int("enforcerPortMax", 65535, "The highest port number to grant allowed peers access to")
+	logFormat            = flag.String("logFormat", "text", "The log output format: \"text\" or \"json\"")
+	logLevel             = flag.String("logLevel", "info", "The minimum log level to emit: \"debug\", \"info\", \"warn\" or \"error\"")
+	adminPort            = flag.Int("adminPort", 9090, "The port to serve /metrics, /healthz and /debug/pprof on")
+)
+
+func main() {
+	flag.Parse()
+	configureLogging()
+	ctx := context.Background()
+	slog.Info("Starting port knock server...")
+
+	enforcer, err := knockd.NewEnforcer(*enforcerKind, *enforcerSetName, *enforcerChainName, *enforcerPortMin, *enforcerPortMax)
+	if err != nil {
+		fatal("Failed to initialize enforcer", "error", err)
+	}
+	slog.Info("Using enforcer", "enforcer", *enforcerKind)
+
+	cfg := knockd.Config{
+		SequenceMode:    *sequenceMode,
+		AccessDuration:  *accessDuration,
+		KnockSessionTTL: *knockSessionTTL,
+		Enforcer:        enforcer,
+		Metrics:         newPrometheusMetrics(),
+	}
+	switch *sequenceMode {
+	case "totp":
+		validateTOTPPortRange()
+		cfg.TOTPSecret = loadSharedSecret()
+		cfg.SequencePeriod = *sequencePeriod
+		cfg.KnockLength = *knockLength
+		cfg.PortMin = *portMin
+		cfg.PortMax = *portMax
+	case "static":
+		cfg.ValidKnockSequence = parseKnockSequence()
+	default:
+		fatal("Unknown --sequenceMode, want \"static\" or \"totp\"", "sequenceMode", *sequenceMode)
+	}
+	srv := knockd.New(cfg)
+	limiter := newIPRateLimiter(*knockRate, *knockBurst, *knockRateIdleTTL)
+
+	gracefulshutdown.AddShutdownHandler(func() error {
+		slog.Info("Shutting down port knock server...")
+		defer slog.Info("Port knock server shut down.")
+		return nil
+	})
+	peerManagerContext, peerManagerCancel := context.WithCancel(ctx)
+	gracefulshutdown.AddShutdownHandler(func() error {
+		slog.Info("Shutting down peer manager...")
+		defer slog.Info("Peer manager shut down.")
+		peerManagerCancel()
+		return nil
+	})
+	startPeerManager(peerManagerContext, srv, limiter)
+	startBaseServer(ctx, srv)
+	startAdminServer(ctx, srv)
+
+	switch *mode {
+	case "sequence":
+		startKnockServers(ctx, srv, limiter)
+	case "spa":
+		srv.EnableSPA(knockd.SPAConfig{
+			SharedSecret:   loadSharedSecret(),
+			Window:         *spaWindow,
+			NonceCacheSize: *spaNonceCacheSize,
+			MaxDuration:    *spaMaxAccessDuration,
+		})
+		startSpaServer(ctx, srv, limiter)
+	default:
+		fatal("Unknown --mode, want \"sequence\" or \"spa\"", "mode", *mode)
+	}
+
+	gracefulshutdown.WaitForShutdown()
+}
+
+// configureLogging installs the default slog logger per --logFormat and
+// --logLevel.
+func configureLogging() {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		fatal("Invalid --logLevel", "logLevel", *logLevel, "error", err)
+	}
+	opts := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	switch *logFormat {
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	default:
+		fatal("Unknown --logFormat, want \"text\" or \"json\"", "logFormat", *logFormat)
+	}
+	slog.SetDefault(slog.New(handler))
+}
+
+// fatal logs msg and args at error level and exits, standing in for
+// log.Fatal now that slog has no equivalent.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+func startPeerManager(ctx context.Context, srv *knockd.Server, limiter *ipRateLimiter) {
+	slog.Info("Starting peer manager")
+	go func() {
+		slog.Info("Started peer manager")
+		ticker := time.NewTicker(1 * time.Second)
+		for {
+			select {
+			case <-ctx.Done():
+				slog.Info("Shutting down peer manager...")
+				return
+			case <-ticker.C:
+				srv.ExpireStalePeers()
+				srv.ExpireStaleKnockSessions()
+				limiter.EvictIdle()
+			}
+		}
+	}()
+}
+
+func startBaseServer(ctx context.Context, srv *knockd.Server) {
+	startHttpServer(ctx, *basePort, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peer, err := getPeer(r)
+		if err != nil {
+			slog.Error("Error getting peer", "error", err)
+			http.Error(w, "Error getting peer", http.StatusInternalServerError)
+			return
+		}
+
+		if !srv.IsPeerAllowed(peer) {
+			slog.Info("Peer is not allowed", "peer", peer)
+			srv.LogAllowedPeers()
+			accessDenialsTotal.Inc()
+			http.Error(w, "Access denied!", http.StatusForbidden)
+			return
+		}
+
+		w.Write([]byte("Access granted!"))
+	}))
+}
+
+func startKnockServers(ctx context.Context, srv *knockd.Server, limiter *ipRateLimiter) {
+	for _, port := range knockListenPorts() {
+		go func(port int) {
+			startHttpServer(ctx, port, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				peer, err := getPeer(r)
+				if err != nil {
+					slog.Error("Error getting peer", "error", err)
+					http.Error(w, "Error getting peer", http.StatusInternalServerError)
+					return
+				}
+
+				if !limiter.Allow(peer) {
+					slog.Warn("Peer exceeded knock rate limit", "peer", peer, "port", port)
+					http.Error(w, "Too many knocks", http.StatusTooManyRequests)
+					return
+				}
+
+				switch srv.Knock(peer, port) {
+				case knockd.KnockAlreadyAllowed:
+					slog.Info("Peer is already allowed", "peer", peer, "port", port)
+					srv.LogAllowedPeers()
+					w.Write([]byte("You are already allowed access!"))
+				case knockd.KnockSequenceComplete:
+					srv.LogAllowedPeers()
+					w.Write([]byte("Access granted!"))
+				case knockd.KnockRecorded:
+					w.Write([]byte("Knock, knock!"))
+				}
+			}))
+		}(port)
+	}
+}
+
+// knockListenPorts returns the ports startKnockServers should listen on: a
+// fixed range above --basePort in static mode, or every port the rotating
+// totp sequence might use, since the target ports change every period.
+func knockListenPorts() []int {
+	if *sequenceMode == "totp" {
+		ports := make([]int, 0, *portMax-*portMin+1)
+		for p := *portMin; p <= *portMax; p++ {
+			ports = append(ports, p)
+		}
+		return ports
+	}
+	ports := make([]int, 0, *knockLength)
+	for i := 1; i <= *knockLength; i++ {
+		ports = append(ports, *basePort+i)
+	}
+	return ports
+}
+
+func startSpaServer(ctx context.Context, srv *knockd.Server, limiter *ipRateLimiter) {
+	conn, err := net.ListenPacket("udp", fmt.Sprintf(":%d", *spaPort))
+	if err != nil {
+		fatal("Failed to listen for SPA packets", "error", err)
+	}
+	gracefulshutdown.AddShutdownHandler(func() error {
+		slog.Info("Shutting down SPA server...")
+		defer slog.Info("SPA server shut down.")
+		return conn.Close()
+	})
+
+	go func() {
+		slog.Info("SPA server listening", "port", *spaPort)
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				select {
+				case <-ctx.Done():
+					return
+				default:
+				}
+				slog.Error("Error reading SPA packet", "error", err)
+				continue
+			}
+
+			host, _, err := net.SplitHostPort(addr.String())
+			if err != nil {
+				slog.Error("Error getting SPA peer", "error", err)
+				continue
+			}
+			peer, err := netip.ParseAddr(host)
+			if err != nil {
+				slog.Error("Error parsing SPA peer", "addr", host, "error", err)
+				continue
+			}
+
+			if !limiter.Allow(peer) {
+				slog.Warn("Peer exceeded knock rate limit", "peer", peer)
+				continue
+			}
+
+			if err := srv.HandleSPAPacket(peer, buf[:n]); err != nil {
+				slog.Warn("Rejected SPA packet", "peer", peer, "error", err)
+				continue
+			}
+			slog.Info("Accepted SPA packet", "peer", peer)
+		}
+	}()
+}
+
+func parseKnockSequence() []int {
+	seq := strings.Split(*knockSequence, ",")
+	sequence := make([]int, len(seq))
+	for i, s := range seq {
+		port, err := strconv.Atoi(s)
+		if err != nil {
+			fatal("Invalid port in knock sequence", "port", s)
+		}
+		sequence[i] = port
+	}
+	slog.Info("Knock sequence", "ports", sequence)
+	return sequence
+}
+
+// validateTOTPPortRange fails fast if --portMin/--portMax don't contain
+// enough distinct ports for --knockLength, since TOTPSequence would
+// otherwise never find knockLength unique ports and loop forever.
+func validateTOTPPortRange() {
+	if rangeSize := *portMax - *portMin + 1; rangeSize < *knockLength {
+		fatal("--portMin/--portMax range is too small for --knockLength", "portMin", *portMin, "portMax", *portMax, "knockLength", *knockLength)
+	}
+}
+
+// loadSharedSecret resolves the shared secret from --sharedSecret or
+// --sharedSecretFile, preferring the file when both are set.
+func loadSharedSecret() []byte {
+	if *sharedSecretFile != "" {
+		b, err := os.ReadFile(*sharedSecretFile)
+		if err != nil {
+			fatal("Failed to read shared secret file", "error", err)
+		}
+		return []byte(strings.TrimSpace(string(b)))
+	}
+	if *sharedSecret != "" {
+		return []byte(*sharedSecret)
+	}
+	fatal("--mode=spa and --sequenceMode=totp require --sharedSecret or --sharedSecretFile")
+	return nil
+}
+
+func getPeer(r *http.Request) (netip.Addr, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return netip.ParseAddr(host)
+}
+
+func getHostPort(r *http.Request) string {
+	_, hostPort, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		return "-1"
+	}
+	return hostPort
+}
+
+func loggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		slog.Debug("Request received", "method", r.Method, "port", getHostPort(r), "path", r.URL.Path, "remote_addr", r.RemoteAddr)
+		start := time.Now()
+		next.ServeHTTP(w, r)
+		slog.Debug("Request handled", "method", r.Method, "port", getHostPort(r), "path", r.URL.Path, "remote_addr", r.RemoteAddr, "duration", time.Since(start))
+	})
+}
+
+func startHttpServer(ctx context.Context, port int, handler http.Handler) {
+	s := &http.Server{
+		Addr:    fmt.Sprintf(":%d", port),
+		Handler: loggingMiddleware(handler),
+	}
+	gracefulshutdown.AddShutdownHandler(func() error {
+		slog.Info("Shutting down HTTP server...", "port", port)
+		defer slog.Info("HTTP server shut down.", "port", port)
+		return s.Shutdown(ctx)
+	})
+	go func(s *http.Server) {
+		slog.Info("HTTP server listening", "addr", s.Addr)
+		if err := s.ListenAndServe(); err != nil {
+			if err == http.ErrServerClosed {
+				return
+			}
+			fatal("HTTP server failed", "addr", s.Addr, "error", err)
+		}
+	}(s)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/MatthewLavine/portknocker/pkg/knockd"
+)
+
+// prometheusMetrics implements knockd.Metrics by exporting Prometheus
+// counters and a histogram.
+type prometheusMetrics struct {
+	knockAttemptsTotal     *prometheus.CounterVec
+	accessGrantsTotal      prometheus.Counter
+	knockCompletionSeconds prometheus.Histogram
+}
+
+func newPrometheusMetrics() *prometheusMetrics {
+	return &prometheusMetrics{
+		knockAttemptsTotal: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "knock_attempts_total",
+			Help: "Total number of knocks received, labeled by port and result.",
+		}, []string{"port", "result"}),
+		accessGrantsTotal: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "access_grants_total",
+			Help: "Total number of times a peer has been granted access.",
+		}),
+		knockCompletionSeconds: promauto.NewHistogram(prometheus.HistogramOpts{
+			Name:    "knock_completion_seconds",
+			Help:    "Time from a peer's first knock to completing its sequence.",
+			Buckets: prometheus.DefBuckets,
+		}),
+	}
+}
+
+func (m *prometheusMetrics) ObserveKnock(port int, result string) {
+	m.knockAttemptsTotal.WithLabelValues(strconv.Itoa(port), result).Inc()
+}
+
+func (m *prometheusMetrics) ObserveAccessGrant() {
+	m.accessGrantsTotal.Inc()
+}
+
+func (m *prometheusMetrics) ObserveKnockCompletion(d time.Duration) {
+	m.knockCompletionSeconds.Observe(d.Seconds())
+}
+
+// accessDenialsTotal counts requests to the base server rejected because the
+// peer has not completed a knock or SPA exchange. It lives outside
+// prometheusMetrics because knockd.Metrics has no hook for base-server
+// denials, which are handled entirely in cmd/server.
+var accessDenialsTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "access_denials_total",
+	Help: "Total number of requests denied by the base server.",
+})
+
+// registerGauges wires GaugeFuncs that poll srv at scrape time.
+func registerGauges(srv *knockd.Server) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "knock_sessions_active",
+		Help: "Number of knock sessions currently in progress.",
+	}, func() float64 { return float64(srv.ActiveKnockSessionCount()) })
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "allowed_peers",
+		Help: "Number of peers currently granted access.",
+	}, func() float64 { return float64(srv.AllowedPeerCount()) })
+}
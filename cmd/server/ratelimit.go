@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// limiterEntry pairs a per-IP token bucket with the last time it was
+// consulted, so idle entries can be evicted.
+type limiterEntry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// ipRateLimiter enforces a per-source-IP token bucket across the knock
+// endpoints, so a single peer can't brute force the knock sequence or churn
+// through knock sessions arbitrarily fast.
+type ipRateLimiter struct {
+	rate    rate.Limit
+	burst   int
+	idleTTL time.Duration
+
+	mu       sync.Mutex
+	limiters map[netip.Addr]*limiterEntry
+}
+
+func newIPRateLimiter(r float64, burst int, idleTTL time.Duration) *ipRateLimiter {
+	return &ipRateLimiter{
+		rate:     rate.Limit(r),
+		burst:    burst,
+		idleTTL:  idleTTL,
+		limiters: make(map[netip.Addr]*limiterEntry),
+	}
+}
+
+// Allow reports whether a knock from ip should be permitted right now.
+func (l *ipRateLimiter) Allow(ip netip.Addr) bool {
+	l.mu.Lock()
+	entry, ok := l.limiters[ip]
+	if !ok {
+		entry = &limiterEntry{limiter: rate.NewLimiter(l.rate, l.burst)}
+		l.limiters[ip] = entry
+	}
+	entry.lastSeen = time.Now()
+	limiter := entry.limiter
+	l.mu.Unlock()
+	return limiter.Allow()
+}
+
+// EvictIdle discards limiters that have not been consulted in over idleTTL,
+// so a hostile client cycling through source IPs can't grow this map
+// without bound. It is intended to be called periodically by the peer
+// manager, alongside Server.ExpireStaleKnockSessions.
+func (l *ipRateLimiter) EvictIdle() {
+	cutoff := time.Now().Add(-l.idleTTL)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for ip, entry := range l.limiters {
+		if entry.lastSeen.Before(cutoff) {
+			delete(l.limiters, ip)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package knockd
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+)
+
+// tcpProtocol is the IPPROTO_TCP value, matched against the packet's L4
+// protocol so the nft rule only ever opens TCP, mirroring IptablesEnforcer's
+// "-p tcp".
+const tcpProtocol = 6
+
+// Enforcer actually grants and revokes network access for a peer, as
+// opposed to the bookkeeping in allowedPeers which only tracks who *should*
+// have access.
+type Enforcer interface {
+	Allow(ip net.IP, duration time.Duration) error
+	Revoke(ip net.IP) error
+}
+
+// NewEnforcer constructs the Enforcer named by kind ("noop", "nft" or
+// "iptables"), configuring it with the nftables set name, iptables chain
+// name, and target port range as applicable.
+func NewEnforcer(kind, setName, chainName string, portMin, portMax int) (Enforcer, error) {
+	switch kind {
+	case "noop":
+		return NoopEnforcer{}, nil
+	case "nft":
+		return newNftablesEnforcer(setName, portMin, portMax)
+	case "iptables":
+		return newIptablesEnforcer(chainName, portMin, portMax)
+	default:
+		return nil, fmt.Errorf("unknown --enforcer %q, want \"noop\", \"nft\" or \"iptables\"", kind)
+	}
+}
+
+// NoopEnforcer is the original demonstrative behavior: Server.IsPeerAllowed is
+// consulted by the HTTP handlers, but nothing else on the host is touched.
+type NoopEnforcer struct{}
+
+func (NoopEnforcer) Allow(ip net.IP, duration time.Duration) error {
+	slog.Info("noop enforcer: would allow", "peer", ip, "remaining_ttl", duration)
+	return nil
+}
+
+func (NoopEnforcer) Revoke(ip net.IP) error {
+	slog.Info("noop enforcer: would revoke", "peer", ip)
+	return nil
+}
+
+// NftablesEnforcer grants access by adding the peer's address, with a
+// kernel-enforced timeout, to a named set. newNftablesEnforcer creates the
+// "portknocker" table, its input chain and a rule that accepts TCP from
+// addresses in that set to destination ports in [portMin, portMax].
+type NftablesEnforcer struct {
+	conn    *nftables.Conn
+	table   *nftables.Table
+	set     *nftables.Set
+	portMin int
+	portMax int
+}
+
+func newNftablesEnforcer(setName string, portMin, portMax int) (*NftablesEnforcer, error) {
+	conn, err := nftables.New()
+	if err != nil {
+		return nil, fmt.Errorf("connecting to nftables: %w", err)
+	}
+
+	table := conn.AddTable(&nftables.Table{
+		Name:   "portknocker",
+		Family: nftables.TableFamilyIPv4,
+	})
+
+	set := &nftables.Set{
+		Table:      table,
+		Name:       setName,
+		KeyType:    nftables.TypeIPAddr,
+		HasTimeout: true,
+	}
+	if err := conn.AddSet(set, nil); err != nil {
+		return nil, fmt.Errorf("creating nftables set %q: %w", setName, err)
+	}
+
+	chain := conn.AddChain(&nftables.Chain{
+		Name:     "input",
+		Table:    table,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookInput,
+		Priority: nftables.ChainPriorityFilter,
+	})
+	conn.AddRule(&nftables.Rule{
+		Table: table,
+		Chain: chain,
+		Exprs: []expr.Any{
+			// Match source address against the set of allowed peers.
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 12, Len: 4},
+			&expr.Lookup{SourceRegister: 1, SetName: set.Name},
+			// Restrict the pinhole to TCP destination ports in [portMin, portMax].
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 2},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 2, Data: []byte{tcpProtocol}},
+			&expr.Payload{DestRegister: 3, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+			&expr.Cmp{Op: expr.CmpOpGte, Register: 3, Data: binaryutil.BigEndian.PutUint16(uint16(portMin))},
+			&expr.Cmp{Op: expr.CmpOpLte, Register: 3, Data: binaryutil.BigEndian.PutUint16(uint16(portMax))},
+			&expr.Verdict{Kind: expr.VerdictAccept},
+		},
+	})
+
+	if err := conn.Flush(); err != nil {
+		return nil, fmt.Errorf("flushing nftables setup: %w", err)
+	}
+
+	return &NftablesEnforcer{
+		conn:    conn,
+		table:   table,
+		set:     set,
+		portMin: portMin,
+		portMax: portMax,
+	}, nil
+}
+
+func (e *NftablesEnforcer) Allow(ip net.IP, duration time.Duration) error {
+	if err := e.conn.SetAddElements(e.set, []nftables.SetElement{
+		{Key: ip.To4(), Timeout: duration},
+	}); err != nil {
+		return fmt.Errorf("adding %s to nftables set %q: %w", ip, e.set.Name, err)
+	}
+	return e.conn.Flush()
+}
+
+func (e *NftablesEnforcer) Revoke(ip net.IP) error {
+	if err := e.conn.SetDeleteElements(e.set, []nftables.SetElement{
+		{Key: ip.To4()},
+	}); err != nil {
+		return fmt.Errorf("removing %s from nftables set %q: %w", ip, e.set.Name, err)
+	}
+	return e.conn.Flush()
+}
+
+// IptablesEnforcer grants access by inserting a per-peer ACCEPT rule into a
+// dedicated chain. iptables has no native per-rule timeout, so rules are
+// removed explicitly when the peer manager expires the peer.
+type IptablesEnforcer struct {
+	ipt     *iptables.IPTables
+	chain   string
+	portMin int
+	portMax int
+}
+
+func newIptablesEnforcer(chain string, portMin, portMax int) (*IptablesEnforcer, error) {
+	ipt, err := iptables.New()
+	if err != nil {
+		return nil, fmt.Errorf("initializing iptables: %w", err)
+	}
+	if err := ipt.ClearAndDeleteChain("filter", chain); err != nil {
+		slog.Warn("Ignoring error clearing iptables chain (may not exist yet)", "chain", chain, "error", err)
+	}
+	if err := ipt.NewChain("filter", chain); err != nil {
+		return nil, fmt.Errorf("creating iptables chain %q: %w", chain, err)
+	}
+	if err := ipt.AppendUnique("filter", "INPUT", "-j", chain); err != nil {
+		return nil, fmt.Errorf("jumping INPUT to iptables chain %q: %w", chain, err)
+	}
+	return &IptablesEnforcer{ipt: ipt, chain: chain, portMin: portMin, portMax: portMax}, nil
+}
+
+func (e *IptablesEnforcer) rule(ip net.IP) []string {
+	return []string{
+		"-s", ip.String(),
+		"-p", "tcp",
+		"--dport", fmt.Sprintf("%d:%d", e.portMin, e.portMax),
+		"-j", "ACCEPT",
+	}
+}
+
+func (e *IptablesEnforcer) Allow(ip net.IP, duration time.Duration) error {
+	if err := e.ipt.AppendUnique("filter", e.chain, e.rule(ip)...); err != nil {
+		return fmt.Errorf("adding iptables rule for %s: %w", ip, err)
+	}
+	return nil
+}
+
+func (e *IptablesEnforcer) Revoke(ip net.IP) error {
+	if err := e.ipt.DeleteIfExists("filter", e.chain, e.rule(ip)...); err != nil {
+		return fmt.Errorf("removing iptables rule for %s: %w", ip, err)
+	}
+	return nil
+}
@@ -0,0 +1,295 @@
+// Package knockd implements the port-knocking and single packet
+// authorization (SPA) state machine used by the portknocker server. It is
+// safe for concurrent use and can be embedded by other Go programs.
+package knockd
+
+import (
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// allowedPeer records that a peer has been granted access until end.
+type allowedPeer struct {
+	start time.Time
+	end   time.Time
+}
+
+// knockSession tracks the in-progress sequence of ports a peer has knocked
+// on, validated against a specific valid sequence chosen when the session
+// was created (in --sequenceMode=totp, the sequence rotates, so once a peer
+// picks a step's sequence it must complete against that same one).
+type knockSession struct {
+	knocks      []int
+	sequence    []int
+	startedAt   time.Time
+	lastKnockAt time.Time
+}
+
+// KnockResult describes the outcome of a single call to Server.Knock.
+type KnockResult int
+
+const (
+	// KnockRecorded means the knock did not complete the sequence. It is
+	// returned both for an accepted knock and for one rejected as out of
+	// order.
+	KnockRecorded KnockResult = iota
+	// KnockSequenceComplete means this knock completed the sequence and
+	// access was requested for the peer. If the Enforcer fails to grant it,
+	// the peer is not recorded as allowed.
+	KnockSequenceComplete
+	// KnockAlreadyAllowed means the peer already had access and the knock
+	// was ignored.
+	KnockAlreadyAllowed
+)
+
+// Config configures a Server.
+type Config struct {
+	// ValidKnockSequence is the ordered list of ports that make up a
+	// complete knock. Ignored when SequenceMode is "totp".
+	ValidKnockSequence []int
+	// SequenceMode selects how the valid knock sequence is derived: "static"
+	// (the default) uses ValidKnockSequence as-is, "totp" recomputes it
+	// every SequencePeriod from TOTPSecret.
+	SequenceMode string
+	// TOTPSecret keys the HMAC used to derive the rotating knock sequence
+	// when SequenceMode is "totp".
+	TOTPSecret []byte
+	// SequencePeriod is how often the totp knock sequence rotates.
+	SequencePeriod time.Duration
+	// KnockLength is the number of ports in a totp knock sequence.
+	KnockLength int
+	// PortMin and PortMax bound the ports a totp knock sequence may use.
+	PortMin, PortMax int
+	// AccessDuration is how long a peer is granted access for after a
+	// successful knock. SPA grants do not use it: they use the duration the
+	// packet requests, capped by SPAConfig.MaxDuration.
+	AccessDuration time.Duration
+	// KnockSessionTTL is how long an incomplete knock session may sit idle
+	// before it is garbage-collected.
+	KnockSessionTTL time.Duration
+	// Enforcer grants and revokes the access tracked by Server.
+	Enforcer Enforcer
+	// Metrics, if set, is notified of knock and access events. Defaults to
+	// a no-op implementation.
+	Metrics Metrics
+}
+
+// Server owns the knock and peer state for one port-knocking deployment. It
+// is safe for concurrent use by multiple goroutines.
+type Server struct {
+	validKnockSequence []int
+	sequenceMode       string
+	totpSecret         []byte
+	sequencePeriod     time.Duration
+	knockLength        int
+	portMin, portMax   int
+	accessDuration     time.Duration
+	knockSessionTTL    time.Duration
+	enforcer           Enforcer
+	metrics            Metrics
+
+	mu            sync.RWMutex
+	allowedPeers  map[netip.Addr]*allowedPeer
+	knockSessions map[netip.Addr]*knockSession
+
+	spaSecret      []byte
+	spaWindow      time.Duration
+	spaNonces      *nonceCache
+	spaMaxDuration time.Duration
+}
+
+// New constructs a Server from cfg.
+func New(cfg Config) *Server {
+	metrics := cfg.Metrics
+	if metrics == nil {
+		metrics = noopMetrics{}
+	}
+	enforcer := cfg.Enforcer
+	if enforcer == nil {
+		enforcer = NoopEnforcer{}
+	}
+	return &Server{
+		validKnockSequence: cfg.ValidKnockSequence,
+		sequenceMode:       cfg.SequenceMode,
+		totpSecret:         cfg.TOTPSecret,
+		sequencePeriod:     cfg.SequencePeriod,
+		knockLength:        cfg.KnockLength,
+		portMin:            cfg.PortMin,
+		portMax:            cfg.PortMax,
+		accessDuration:     cfg.AccessDuration,
+		knockSessionTTL:    cfg.KnockSessionTTL,
+		enforcer:           enforcer,
+		metrics:            metrics,
+		allowedPeers:       make(map[netip.Addr]*allowedPeer),
+		knockSessions:      make(map[netip.Addr]*knockSession),
+	}
+}
+
+// validSequences returns the knock sequence(s) a new session may currently
+// be started against. In totp mode this includes both the current and
+// previous time step's sequence, to tolerate clock skew between client and
+// server.
+func (s *Server) validSequences() [][]int {
+	if s.sequenceMode != "totp" {
+		return [][]int{s.validKnockSequence}
+	}
+	step := TOTPStep(s.sequencePeriod, time.Now())
+	return [][]int{
+		TOTPSequence(s.totpSecret, step, s.knockLength, s.portMin, s.portMax),
+		TOTPSequence(s.totpSecret, step-1, s.knockLength, s.portMin, s.portMax),
+	}
+}
+
+// IsPeerAllowed reports whether peer currently has access.
+func (s *Server) IsPeerAllowed(peer netip.Addr) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.allowedPeers[peer]
+	return ok
+}
+
+// AllowedPeerCount reports how many peers currently have access.
+func (s *Server) AllowedPeerCount() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.allowedPeers)
+}
+
+// ActiveKnockSessionCount reports how many knock sessions are currently in
+// progress.
+func (s *Server) ActiveKnockSessionCount() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.knockSessions)
+}
+
+// LogAllowedPeers logs the peers that currently have access.
+func (s *Server) LogAllowedPeers() {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.allowedPeers) == 0 {
+		slog.Info("Allowed peers: none")
+		return
+	}
+	for ip, allowed := range s.allowedPeers {
+		slog.Info("Allowed peer", "peer", ip, "remaining_ttl", time.Until(allowed.end).Round(time.Second))
+	}
+}
+
+// AllowPeer grants peer the server's configured access duration.
+func (s *Server) AllowPeer(peer netip.Addr) {
+	s.AllowPeerFor(peer, s.accessDuration)
+}
+
+// AllowPeerFor grants peer access for duration.
+func (s *Server) AllowPeerFor(peer netip.Addr, duration time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.allowPeerForLocked(peer, duration)
+}
+
+func (s *Server) allowPeerForLocked(peer netip.Addr, duration time.Duration) {
+	if _, ok := s.allowedPeers[peer]; ok {
+		slog.Info("Peer is already allowed", "peer", peer)
+		return
+	}
+	slog.Info("Allowing peer", "peer", peer, "remaining_ttl", duration)
+	if err := s.enforcer.Allow(net.IP(peer.AsSlice()), duration); err != nil {
+		slog.Error("Error granting access for peer", "peer", peer, "error", err)
+		return
+	}
+	s.allowedPeers[peer] = &allowedPeer{
+		start: time.Now(),
+		end:   time.Now().Add(duration),
+	}
+	s.metrics.ObserveAccessGrant()
+}
+
+// Knock records a single knock from peer on port and reports what happened.
+// A knock that arrives out of the expected sequence drops the peer's entire
+// session immediately, rather than letting it accumulate further knocks.
+func (s *Server) Knock(peer netip.Addr, port int) KnockResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.allowedPeers[peer]; ok {
+		s.metrics.ObserveKnock(port, "already_allowed")
+		return KnockAlreadyAllowed
+	}
+
+	session, ok := s.knockSessions[peer]
+	if !ok {
+		for _, seq := range s.validSequences() {
+			if len(seq) > 0 && port == seq[0] {
+				now := time.Now()
+				s.knockSessions[peer] = &knockSession{knocks: []int{port}, sequence: seq, startedAt: now, lastKnockAt: now}
+				slog.Info("Created knock session for peer", "peer", peer, "port", port, "session_knocks", []int{port})
+				s.metrics.ObserveKnock(port, "accepted")
+				return KnockRecorded
+			}
+		}
+		slog.Warn("Peer knocked out of order, ignoring", "peer", peer, "port", port)
+		s.metrics.ObserveKnock(port, "rejected")
+		return KnockRecorded
+	}
+
+	next := len(session.knocks)
+	if next >= len(session.sequence) || port != session.sequence[next] {
+		slog.Warn("Peer knocked out of order, dropping knock session", "peer", peer, "port", port, "session_knocks", session.knocks)
+		delete(s.knockSessions, peer)
+		s.metrics.ObserveKnock(port, "rejected")
+		return KnockRecorded
+	}
+
+	session.knocks = append(session.knocks, port)
+	session.lastKnockAt = time.Now()
+	if len(session.knocks) != len(session.sequence) {
+		slog.Info("Peer has an incomplete knock session", "peer", peer, "port", port, "session_knocks", session.knocks)
+		s.metrics.ObserveKnock(port, "accepted")
+		return KnockRecorded
+	}
+
+	slog.Info("Peer completed knock sequence", "peer", peer, "port", port, "session_knocks", session.knocks)
+	delete(s.knockSessions, peer)
+	s.metrics.ObserveKnock(port, "complete")
+	s.metrics.ObserveKnockCompletion(time.Since(session.startedAt))
+	s.allowPeerForLocked(peer, s.accessDuration)
+	return KnockSequenceComplete
+}
+
+// ExpireStalePeers revokes and forgets any peer whose access window has
+// ended. It is intended to be called periodically by a peer-manager
+// goroutine.
+func (s *Server) ExpireStalePeers() {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ip, peer := range s.allowedPeers {
+		if now.After(peer.end) {
+			slog.Info("Removing expired peer", "peer", ip)
+			if err := s.enforcer.Revoke(net.IP(ip.AsSlice())); err != nil {
+				slog.Error("Error revoking access for peer", "peer", ip, "error", err)
+			}
+			delete(s.allowedPeers, ip)
+		}
+	}
+}
+
+// ExpireStaleKnockSessions discards any knock session that has not
+// progressed in longer than the configured knock session TTL, so a peer
+// that starts a knock and never finishes it doesn't hold state forever. It
+// is intended to be called periodically by a peer-manager goroutine.
+func (s *Server) ExpireStaleKnockSessions() {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ip, session := range s.knockSessions {
+		if now.Sub(session.lastKnockAt) > s.knockSessionTTL {
+			slog.Info("Expiring stale knock session for peer", "peer", ip, "session_knocks", session.knocks)
+			delete(s.knockSessions, ip)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package knockd
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeEnforcer records the Allow/Revoke calls made against it, guarded by a
+// mutex since Server may call it from multiple goroutines.
+type fakeEnforcer struct {
+	mu       sync.Mutex
+	allowed  []netip.Addr
+	revoked  []netip.Addr
+	allowErr error
+}
+
+func (e *fakeEnforcer) Allow(ip net.IP, _ time.Duration) error {
+	if e.allowErr != nil {
+		return e.allowErr
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	addr, _ := netip.AddrFromSlice(ip)
+	e.allowed = append(e.allowed, addr)
+	return nil
+}
+
+func (e *fakeEnforcer) Revoke(ip net.IP) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	addr, _ := netip.AddrFromSlice(ip)
+	e.revoked = append(e.revoked, addr)
+	return nil
+}
+
+func (e *fakeEnforcer) allowedCount() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return len(e.allowed)
+}
+
+func (e *fakeEnforcer) revokedCount() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return len(e.revoked)
+}
+
+func newTestServer(enforcer Enforcer) *Server {
+	return New(Config{
+		ValidKnockSequence: []int{1, 2, 3},
+		SequenceMode:       "static",
+		AccessDuration:     time.Minute,
+		KnockSessionTTL:    50 * time.Millisecond,
+		Enforcer:           enforcer,
+	})
+}
+
+func TestServerKnockSequenceCompletesAndAllows(t *testing.T) {
+	enforcer := &fakeEnforcer{}
+	s := newTestServer(enforcer)
+	peer := netip.MustParseAddr("10.0.0.1")
+
+	if r := s.Knock(peer, 1); r != KnockRecorded {
+		t.Fatalf("first knock: got %v, want KnockRecorded", r)
+	}
+	if got := s.ActiveKnockSessionCount(); got != 1 {
+		t.Fatalf("got %d active knock sessions, want 1", got)
+	}
+	if r := s.Knock(peer, 2); r != KnockRecorded {
+		t.Fatalf("second knock: got %v, want KnockRecorded", r)
+	}
+	if r := s.Knock(peer, 3); r != KnockSequenceComplete {
+		t.Fatalf("third knock: got %v, want KnockSequenceComplete", r)
+	}
+
+	if !s.IsPeerAllowed(peer) {
+		t.Fatal("peer should be allowed after completing the sequence")
+	}
+	if got := s.ActiveKnockSessionCount(); got != 0 {
+		t.Fatalf("got %d active knock sessions after completion, want 0", got)
+	}
+	if got := s.AllowedPeerCount(); got != 1 {
+		t.Fatalf("got %d allowed peers, want 1", got)
+	}
+	if got := enforcer.allowedCount(); got != 1 {
+		t.Fatalf("enforcer.Allow called %d times, want 1", got)
+	}
+}
+
+func TestServerKnockOutOfOrderDropsSession(t *testing.T) {
+	s := newTestServer(&fakeEnforcer{})
+	peer := netip.MustParseAddr("10.0.0.2")
+
+	s.Knock(peer, 1)
+	s.Knock(peer, 2)
+	if got := s.ActiveKnockSessionCount(); got != 1 {
+		t.Fatalf("got %d active knock sessions, want 1", got)
+	}
+
+	// Knocking the wrong next port should drop the whole session rather
+	// than accumulate it.
+	s.Knock(peer, 1)
+	if got := s.ActiveKnockSessionCount(); got != 0 {
+		t.Fatalf("got %d active knock sessions after out-of-order knock, want 0", got)
+	}
+	if s.IsPeerAllowed(peer) {
+		t.Fatal("peer should not be allowed after an out-of-order knock")
+	}
+}
+
+func TestServerKnockAlreadyAllowed(t *testing.T) {
+	s := newTestServer(&fakeEnforcer{})
+	peer := netip.MustParseAddr("10.0.0.3")
+
+	s.AllowPeer(peer)
+	if r := s.Knock(peer, 1); r != KnockAlreadyAllowed {
+		t.Fatalf("got %v, want KnockAlreadyAllowed", r)
+	}
+}
+
+func TestAllowPeerForGrantsOnce(t *testing.T) {
+	enforcer := &fakeEnforcer{}
+	s := newTestServer(enforcer)
+	peer := netip.MustParseAddr("10.0.0.4")
+
+	s.AllowPeerFor(peer, time.Minute)
+	s.AllowPeerFor(peer, time.Minute)
+
+	if got := enforcer.allowedCount(); got != 1 {
+		t.Fatalf("enforcer.Allow called %d times, want 1 (second call should be a no-op)", got)
+	}
+}
+
+func TestExpireStalePeersRevokes(t *testing.T) {
+	enforcer := &fakeEnforcer{}
+	s := newTestServer(enforcer)
+	peer := netip.MustParseAddr("10.0.0.5")
+
+	s.AllowPeerFor(peer, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+
+	s.ExpireStalePeers()
+
+	if s.IsPeerAllowed(peer) {
+		t.Fatal("peer should have been expired")
+	}
+	if got := enforcer.revokedCount(); got != 1 {
+		t.Fatalf("enforcer.Revoke called %d times, want 1", got)
+	}
+}
+
+func TestExpireStaleKnockSessions(t *testing.T) {
+	s := newTestServer(&fakeEnforcer{})
+	peer := netip.MustParseAddr("10.0.0.6")
+
+	s.Knock(peer, 1)
+	if got := s.ActiveKnockSessionCount(); got != 1 {
+		t.Fatalf("got %d active knock sessions, want 1", got)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	s.ExpireStaleKnockSessions()
+
+	if got := s.ActiveKnockSessionCount(); got != 0 {
+		t.Fatalf("got %d active knock sessions after TTL, want 0", got)
+	}
+}
+
+// buildTestSPAPacket mirrors the wire format client/spa.go produces, so
+// HandleSPAPacket can be exercised without depending on the client package.
+func buildTestSPAPacket(secret []byte, sentAt time.Time, duration time.Duration, nonce byte) []byte {
+	header := make([]byte, spaHeaderSize)
+	header[0] = spaPacketVersion
+	for i := 0; i < spaNonceSize; i++ {
+		header[spaVersionSize+i] = nonce
+	}
+	tsOffset := spaVersionSize + spaNonceSize
+	binary.BigEndian.PutUint64(header[tsOffset:tsOffset+spaTimestampSize], uint64(sentAt.Unix()))
+	durOffset := tsOffset + spaTimestampSize
+	binary.BigEndian.PutUint64(header[durOffset:durOffset+spaDurationSize], uint64(duration))
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(header)
+	return append(header, mac.Sum(nil)...)
+}
+
+func newTestSPAServer(secret []byte, maxDuration time.Duration) *Server {
+	s := newTestServer(&fakeEnforcer{})
+	s.EnableSPA(SPAConfig{
+		SharedSecret:   secret,
+		Window:         30 * time.Second,
+		NonceCacheSize: 16,
+		MaxDuration:    maxDuration,
+	})
+	return s
+}
+
+func TestHandleSPAPacketAllowsOnSuccess(t *testing.T) {
+	secret := []byte("test-secret")
+	s := newTestSPAServer(secret, time.Hour)
+	peer := netip.MustParseAddr("10.0.1.1")
+
+	packet := buildTestSPAPacket(secret, time.Now(), time.Minute, 0x01)
+	if err := s.HandleSPAPacket(peer, packet); err != nil {
+		t.Fatalf("HandleSPAPacket: %v", err)
+	}
+	if !s.IsPeerAllowed(peer) {
+		t.Fatal("peer should be allowed after a valid SPA packet")
+	}
+}
+
+func TestHandleSPAPacketRejectsReplay(t *testing.T) {
+	secret := []byte("test-secret")
+	s := newTestSPAServer(secret, time.Hour)
+	peer := netip.MustParseAddr("10.0.1.2")
+
+	packet := buildTestSPAPacket(secret, time.Now(), time.Minute, 0x02)
+	if err := s.HandleSPAPacket(peer, packet); err != nil {
+		t.Fatalf("first HandleSPAPacket: %v", err)
+	}
+	if err := s.HandleSPAPacket(peer, packet); err == nil {
+		t.Fatal("replayed SPA packet should be rejected")
+	}
+}
+
+func TestHandleSPAPacketRejectsBadHMAC(t *testing.T) {
+	s := newTestSPAServer([]byte("test-secret"), time.Hour)
+	peer := netip.MustParseAddr("10.0.1.3")
+
+	packet := buildTestSPAPacket([]byte("wrong-secret"), time.Now(), time.Minute, 0x03)
+	if err := s.HandleSPAPacket(peer, packet); err == nil {
+		t.Fatal("SPA packet with a bad HMAC should be rejected")
+	}
+}
+
+func TestHandleSPAPacketClampsDuration(t *testing.T) {
+	secret := []byte("test-secret")
+	s := newTestSPAServer(secret, time.Minute)
+
+	packet := buildTestSPAPacket(secret, time.Now(), 24*time.Hour, 0x04)
+	duration, err := s.verifySPAPacket(packet)
+	if err != nil {
+		t.Fatalf("verifySPAPacket: %v", err)
+	}
+	if duration != time.Minute {
+		t.Fatalf("got duration %s, want it clamped to %s", duration, time.Minute)
+	}
+}
+
+func TestHandleSPAPacketRejectsStaleTimestamp(t *testing.T) {
+	secret := []byte("test-secret")
+	s := newTestSPAServer(secret, time.Hour)
+	peer := netip.MustParseAddr("10.0.1.5")
+
+	packet := buildTestSPAPacket(secret, time.Now().Add(-time.Hour), time.Minute, 0x05)
+	if err := s.HandleSPAPacket(peer, packet); err == nil {
+		t.Fatal("SPA packet with a stale timestamp should be rejected")
+	}
+}
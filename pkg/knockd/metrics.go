@@ -0,0 +1,24 @@
+package knockd
+
+import "time"
+
+// Metrics receives notifications about knock and access events, decoupling
+// Server from any particular metrics backend (e.g. Prometheus).
+type Metrics interface {
+	// ObserveKnock records a single knock on port with an outcome of
+	// "accepted", "complete", "rejected" or "already_allowed".
+	ObserveKnock(port int, result string)
+	// ObserveAccessGrant records a peer being granted access.
+	ObserveAccessGrant()
+	// ObserveKnockCompletion records the time from a peer's first knock to
+	// completing its sequence.
+	ObserveKnockCompletion(d time.Duration)
+}
+
+// noopMetrics is the default Metrics used when a Config does not provide
+// one.
+type noopMetrics struct{}
+
+func (noopMetrics) ObserveKnock(int, string)             {}
+func (noopMetrics) ObserveAccessGrant()                  {}
+func (noopMetrics) ObserveKnockCompletion(time.Duration) {}
@@ -0,0 +1,137 @@
+package knockd
+
+import (
+	"container/list"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"time"
+)
+
+const (
+	spaPacketVersion = 1
+
+	spaVersionSize   = 1
+	spaNonceSize     = 16
+	spaTimestampSize = 8
+	spaDurationSize  = 8
+	spaHeaderSize    = spaVersionSize + spaNonceSize + spaTimestampSize + spaDurationSize
+	spaHMACSize      = sha256.Size
+	spaPacketSize    = spaHeaderSize + spaHMACSize
+)
+
+// nonceCache is a bounded LRU of recently seen SPA nonces, used to reject
+// replayed packets. It is guarded by Server's mutex and must not be used on
+// its own.
+type nonceCache struct {
+	capacity int
+	order    *list.List
+	seen     map[string]*list.Element
+}
+
+func newNonceCache(capacity int) *nonceCache {
+	return &nonceCache{
+		capacity: capacity,
+		order:    list.New(),
+		seen:     make(map[string]*list.Element),
+	}
+}
+
+// seenBefore reports whether nonce has already been recorded, and records it
+// if not.
+func (c *nonceCache) seenBefore(nonce string) bool {
+	if _, ok := c.seen[nonce]; ok {
+		return true
+	}
+	elem := c.order.PushFront(nonce)
+	c.seen[nonce] = elem
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		if oldest == nil {
+			break
+		}
+		c.order.Remove(oldest)
+		delete(c.seen, oldest.Value.(string))
+	}
+	return false
+}
+
+// SPAConfig configures a Server's handling of single packet authorization
+// packets.
+type SPAConfig struct {
+	SharedSecret   []byte
+	Window         time.Duration
+	NonceCacheSize int
+	// MaxDuration caps the access duration an SPA packet may request. A
+	// packet requesting longer than this is granted MaxDuration instead, so
+	// a holder of the shared secret can't request access far beyond what
+	// the operator intends to allow.
+	MaxDuration time.Duration
+}
+
+// EnableSPA configures s to accept SPA packets per cfg. It must be called
+// before any call to HandleSPAPacket.
+func (s *Server) EnableSPA(cfg SPAConfig) {
+	s.spaSecret = cfg.SharedSecret
+	s.spaWindow = cfg.Window
+	s.spaNonces = newNonceCache(cfg.NonceCacheSize)
+	s.spaMaxDuration = cfg.MaxDuration
+}
+
+// HandleSPAPacket validates packet as an SPA request from peer and, on
+// success, grants peer the access it requests.
+func (s *Server) HandleSPAPacket(peer netip.Addr, packet []byte) error {
+	duration, err := s.verifySPAPacket(packet)
+	if err != nil {
+		return err
+	}
+	s.AllowPeerFor(peer, duration)
+	return nil
+}
+
+// verifySPAPacket validates the structure, HMAC, freshness and novelty of an
+// SPA packet and returns the requested access duration on success.
+func (s *Server) verifySPAPacket(packet []byte) (time.Duration, error) {
+	if len(packet) != spaPacketSize {
+		return 0, fmt.Errorf("invalid packet size %d, want %d", len(packet), spaPacketSize)
+	}
+	if packet[0] != spaPacketVersion {
+		return 0, fmt.Errorf("unsupported packet version %d", packet[0])
+	}
+
+	header := packet[:spaHeaderSize]
+	gotMAC := packet[spaHeaderSize:spaPacketSize]
+
+	mac := hmac.New(sha256.New, s.spaSecret)
+	mac.Write(header)
+	wantMAC := mac.Sum(nil)
+	if !hmac.Equal(gotMAC, wantMAC) {
+		return 0, fmt.Errorf("HMAC verification failed")
+	}
+
+	nonce := string(packet[spaVersionSize : spaVersionSize+spaNonceSize])
+
+	s.mu.Lock()
+	replayed := s.spaNonces.seenBefore(nonce)
+	s.mu.Unlock()
+	if replayed {
+		return 0, fmt.Errorf("replayed nonce")
+	}
+
+	tsOffset := spaVersionSize + spaNonceSize
+	ts := int64(binary.BigEndian.Uint64(packet[tsOffset : tsOffset+spaTimestampSize]))
+	sentAt := time.Unix(ts, 0)
+	if skew := time.Since(sentAt); skew < -s.spaWindow || skew > s.spaWindow {
+		return 0, fmt.Errorf("timestamp %s outside of allowed window %s", sentAt, s.spaWindow)
+	}
+
+	durOffset := tsOffset + spaTimestampSize
+	duration := time.Duration(binary.BigEndian.Uint64(packet[durOffset : durOffset+spaDurationSize]))
+	if s.spaMaxDuration > 0 && (duration <= 0 || duration > s.spaMaxDuration) {
+		duration = s.spaMaxDuration
+	}
+
+	return duration, nil
+}
@@ -0,0 +1,55 @@
+package knockd
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"time"
+)
+
+// totpWindowSize is the number of bytes of HMAC-SHA1 output consumed per
+// candidate port.
+const totpWindowSize = 2
+
+// TOTPStep returns the time step that at falls into for a sequence that
+// rotates every period. It is exported so that clients can derive the same
+// step the server will check against.
+func TOTPStep(period time.Duration, at time.Time) int64 {
+	seconds := int64(period.Seconds())
+	if seconds <= 0 {
+		seconds = 1
+	}
+	return at.Unix() / seconds
+}
+
+// TOTPSequence derives the length-port knock sequence valid for step, by
+// mapping successive 2-byte windows of HMAC-SHA1(secret, step || block) into
+// ports in [portMin, portMax], skipping windows that would produce a port
+// already chosen. block starts at 0 and is incremented whenever a block's
+// windows run out before length ports are found. This is TOTP-style (RFC 6238) in that the step, not a counter, is
+// what is HMAC'd, but the output is reinterpreted as a set of ports rather
+// than a numeric code. It is exported so that clients can compute the same
+// ports the server expects without sharing any state beyond the secret.
+func TOTPSequence(secret []byte, step int64, length, portMin, portMax int) []int {
+	rangeSize := portMax - portMin + 1
+	seen := make(map[int]bool, length)
+	sequence := make([]int, 0, length)
+
+	for block := int64(0); len(sequence) < length; block++ {
+		mac := hmac.New(sha1.New, secret)
+		binary.Write(mac, binary.BigEndian, step)
+		binary.Write(mac, binary.BigEndian, block)
+		sum := mac.Sum(nil)
+
+		for w := 0; w+totpWindowSize <= len(sum) && len(sequence) < length; w += totpWindowSize {
+			port := portMin + int(binary.BigEndian.Uint16(sum[w:w+totpWindowSize]))%rangeSize
+			if seen[port] {
+				continue
+			}
+			seen[port] = true
+			sequence = append(sequence, port)
+		}
+	}
+
+	return sequence
+}
@@ -0,0 +1,87 @@
+package knockd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTOTPSequenceDeterministic(t *testing.T) {
+	secret := []byte("shared-secret")
+	a := TOTPSequence(secret, 42, 3, 8081, 8090)
+	b := TOTPSequence(secret, 42, 3, 8081, 8090)
+	if len(a) != 3 || len(b) != 3 {
+		t.Fatalf("got sequences of length %d and %d, want 3", len(a), len(b))
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			t.Fatalf("sequence for the same step differs: %v vs %v", a, b)
+		}
+	}
+}
+
+func TestTOTPSequenceBounds(t *testing.T) {
+	secret := []byte("shared-secret")
+	portMin, portMax := 8081, 8090
+	seq := TOTPSequence(secret, 7, 5, portMin, portMax)
+	if len(seq) != 5 {
+		t.Fatalf("got sequence of length %d, want 5", len(seq))
+	}
+	seen := make(map[int]bool, len(seq))
+	for _, port := range seq {
+		if port < portMin || port > portMax {
+			t.Errorf("port %d outside of configured range [%d, %d]", port, portMin, portMax)
+		}
+		if seen[port] {
+			t.Errorf("port %d repeated in sequence %v", port, seq)
+		}
+		seen[port] = true
+	}
+}
+
+func TestTOTPSequenceChangesWithStep(t *testing.T) {
+	secret := []byte("shared-secret")
+	a := TOTPSequence(secret, 1, 3, 8081, 8090)
+	b := TOTPSequence(secret, 2, 3, 8081, 8090)
+	equal := len(a) == len(b)
+	for i := range a {
+		if i >= len(b) || a[i] != b[i] {
+			equal = false
+		}
+	}
+	if equal {
+		t.Fatalf("sequences for different steps should (overwhelmingly likely) differ, both were %v", a)
+	}
+}
+
+func TestTOTPSequenceChangesWithSecret(t *testing.T) {
+	a := TOTPSequence([]byte("secret-a"), 1, 3, 8081, 8090)
+	b := TOTPSequence([]byte("secret-b"), 1, 3, 8081, 8090)
+	equal := len(a) == len(b)
+	for i := range a {
+		if i >= len(b) || a[i] != b[i] {
+			equal = false
+		}
+	}
+	if equal {
+		t.Fatalf("sequences for different secrets should (overwhelmingly likely) differ, both were %v", a)
+	}
+}
+
+func TestTOTPStep(t *testing.T) {
+	period := 30 * time.Second
+	t0 := time.Unix(1000, 0)
+	t1 := time.Unix(1019, 0)
+	t2 := time.Unix(1020, 0)
+
+	if TOTPStep(period, t0) != TOTPStep(period, t1) {
+		t.Errorf("expected %s and %s to fall in the same %s step", t0, t1, period)
+	}
+	if TOTPStep(period, t0) == TOTPStep(period, t2) {
+		t.Errorf("expected %s and %s to fall in different %s steps", t0, t2, period)
+	}
+}
+
+func TestTOTPStepZeroPeriod(t *testing.T) {
+	// A non-positive period must not panic or divide by zero.
+	TOTPStep(0, time.Now())
+}